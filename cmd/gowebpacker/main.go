@@ -0,0 +1,22 @@
+// Command gowebpacker walks a directory of static assets and writes a
+// single pre-compressed packfile for gowebcompress/pack to serve.
+package main
+
+import (
+	"flag"
+	"log"
+	"runtime"
+
+	"github.com/snadrus/gowebcompress/pack"
+)
+
+func main() {
+	srcDir := flag.String("src", ".", "directory of static assets to pack")
+	outPath := flag.String("out", "assets.pack", "output packfile path")
+	workers := flag.Int("workers", runtime.NumCPU(), "parallel compression workers")
+	flag.Parse()
+
+	if err := pack.Build(pack.BuildOpts{SrcDir: *srcDir, OutPath: *outPath, Workers: *workers}); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -12,25 +12,29 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/itchio/go-brotli/enc"
+	"github.com/klauspost/compress/zstd"
 )
 
-var DynamicLevels = Levels{2, 2}
-var StaticLevels = Levels{6, 4}
+var DynamicLevels = Levels{2, 2, int(zstd.SpeedFastest)}
+var StaticLevels = Levels{6, 4, int(zstd.SpeedBestCompression)}
 
 const (
-	none   = iota
-	gzType = iota
-	brType = iota
+	none    = iota
+	gzType  = iota
+	brType  = iota
+	zstType = iota
 )
 
 type Levels struct {
 	Gzip   int
 	Brotli int
+	Zstd   int
 }
 
 type outBuf struct {
@@ -45,7 +49,7 @@ type outBuf struct {
 
 var bufpool = &sync.Pool{
 	New: func() interface{} {
-		return make([]byte, 0, 1024)
+		return make([]byte, 0, sampleSize)
 	},
 }
 
@@ -88,7 +92,7 @@ func Handler(w http.ResponseWriter, req *http.Request) (newWriter http.ResponseW
 
 func (o *outBuf) Write(b []byte) (i int, err error) {
 	if o.compressor == nil {
-		if len(o.b)+len(b) < 1024 { // under 1024 bytes
+		if len(o.b)+len(b) < sampleSize { // under the sample threshold
 			if o.b == nil {
 				o.b = bufpool.Get().([]byte)
 			}
@@ -113,16 +117,78 @@ func (o *outBuf) compressorCatchup(l Levels, cacher *fsCache) (int, error) {
 }
 
 func (o *outBuf) getCompressWriter(req *http.Request, output io.Writer, l Levels, cacher *fsCache) (input io.WriteCloser, encoding int, err error) {
-	encoding = o.shouldCompress()
+	encoding = o.shouldCompress(l)
+	if encoding != none && SampleCompress && !o.sampleCompressible(encoding, l) {
+		encoding = none
+	}
 	input, err = makeCompressor(encoding, o.ResponseWriter, l, cacher)
 	return input, encoding, err
 }
 
+// sampleCompressible compresses the buffered sample and reports whether its
+// compressed/original size ratio is at most MinCompressRatio. Used once,
+// before committing to a compressor, so responses whose MIME is unknown or
+// misleading still get skipped. The sample is what Write buffered before
+// crossing sampleSize (fewer than sampleSize bytes; the Write that crossed
+// it isn't included). With nothing buffered, e.g. when the first Write
+// alone reaches sampleSize, it reports true without sampling.
+func (o *outBuf) sampleCompressible(encoding int, l Levels) bool {
+	if len(o.b) == 0 {
+		return true
+	}
+	n, err := compressedSampleSize(encoding, l, o.b)
+	if err != nil {
+		return true // can't tell; don't block compression
+	}
+	return float64(n)/float64(len(o.b)) <= MinCompressRatio
+}
+
+// compressedSampleSize runs sample through the given encoding and returns
+// the resulting size, without ever touching the real output.
+func compressedSampleSize(encoding int, l Levels, sample []byte) (int, error) {
+	var out countingWriter
+	var cmp io.WriteCloser
+	var err error
+	switch encoding {
+	case gzType:
+		cmp, err = gzip.NewWriterLevel(&out, l.Gzip)
+	case brType:
+		cmp = enc.NewBrotliWriter(&out, &enc.BrotliWriterOptions{Quality: l.Brotli})
+	case zstType:
+		cmp, err = zstd.NewWriter(&out, zstd.WithEncoderLevel(zstd.EncoderLevel(l.Zstd)))
+	default:
+		return len(sample), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := cmp.Write(sample); err != nil {
+		return 0, err
+	}
+	if err := cmp.Close(); err != nil {
+		return 0, err
+	}
+	return out.n, nil
+}
+
+// countingWriter discards bytes while counting how many were written.
+type countingWriter struct{ n int }
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.n += len(b)
+	return len(b), nil
+}
+
 func makeCompressor(encoding int, w http.ResponseWriter, levels Levels, cacher *fsCache) (input io.WriteCloser, err error) {
 	var cmp io.WriteCloser
 	h := w.Header()
 	var out io.Writer = w
-	if cacher != nil {
+	// Only multiplex into the on-disk cache file when we're actually
+	// compressing. When encoding is none (e.g. the sample check downgraded
+	// it), leaving cacher.disk unwritten keeps dest at zero bytes, the same
+	// "don't bother" sentinel makeStaticCompressed writes, instead of raw
+	// bytes under a .gz/.br/.zst name.
+	if cacher != nil && encoding != none {
 		out = io.MultiWriter(cacher.disk, w)
 	}
 	switch encoding {
@@ -136,6 +202,12 @@ func makeCompressor(encoding int, w http.ResponseWriter, levels Levels, cacher *
 		var brotliParam = &enc.BrotliWriterOptions{Quality: levels.Brotli}
 		cmp = enc.NewBrotliWriter(out, brotliParam)
 		headersFor(h, encoding)
+	case zstType:
+		cmp, err = zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.EncoderLevel(levels.Zstd)))
+		if err != nil {
+			return nil, err
+		}
+		headersFor(h, encoding)
 	default:
 		cmp = &fakecloser{out} // closer may be double-called
 	}
@@ -148,17 +220,22 @@ func makeCompressor(encoding int, w http.ResponseWriter, levels Levels, cacher *
 }
 
 var ceString = map[int]string{
-	gzType: "gzip",
-	brType: "br",
-	none:   "identity",
+	gzType:  "gzip",
+	brType:  "br",
+	zstType: "zstd",
+	none:    "identity",
 }
 
 func headersFor(h http.Header, encoding int) {
-	delete(h, "content-length")
-	delete(h, "Content-Length")
 	ce := "Content-Encoding"
 	if h.Get("Content-Range") != "" {
+		// A range response's Content-Length describes the slice being
+		// sent, not the whole body, so it must stay; only the encoding
+		// header swaps to TE.
 		ce = "TE"
+	} else {
+		delete(h, "content-length")
+		delete(h, "Content-Length")
 	}
 	h.Set(ce, ceString[encoding])
 }
@@ -169,7 +246,7 @@ type fakecloser struct {
 
 func (f *fakecloser) Close() error { return nil }
 
-func (o *outBuf) shouldCompress() int {
+func (o *outBuf) shouldCompress(l Levels) int {
 	// pprof acts badly
 	p := o.req.URL.Path
 	if len(p) > 11 && p[:12] == "/debug/pprof" {
@@ -182,11 +259,19 @@ func (o *outBuf) shouldCompress() int {
 	}
 
 	// The browser wants...
-	return browserWants(o.req)
+	return dynamicEncoding(o.req, l)
 }
 
+// browserWants picks the strongest encoding the client advertises, with no
+// regard for whether we can actually produce it. It's used by
+// StaticObj.SendFile, so an encoding disabled there (its s.gz/s.br/s.zs is
+// 0) is still picked when advertised: the walker never pre-compresses it,
+// so SendFile compresses each such response on the fly at StaticLevels.
 func browserWants(r *http.Request) int {
 	ae := r.Header.Get("Accept-Encoding")
+	if strings.Contains(ae, "zstd") {
+		return zstType
+	}
 	if strings.Contains(ae, "br") && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
 		return brType
 	}
@@ -196,6 +281,24 @@ func browserWants(r *http.Request) int {
 	return none
 }
 
+// dynamicEncoding is browserWants scoped to what l actually allows,
+// falling back down the zstd->brotli->gzip->none chain so disabling an
+// encoding (setting its Levels field to 0) degrades gracefully instead of
+// handing makeCompressor a level it can't pass to its encoder.
+func dynamicEncoding(r *http.Request, l Levels) int {
+	ae := r.Header.Get("Accept-Encoding")
+	if strings.Contains(ae, "zstd") && l.Zstd != 0 {
+		return zstType
+	}
+	if strings.Contains(ae, "br") && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") && l.Brotli != 0 {
+		return brType
+	}
+	if strings.Contains(ae, "gzip") && l.Gzip != 0 {
+		return gzType
+	}
+	return none
+}
+
 func alreadyCompressed(mime string) bool {
 	if len(mime) >= 5 {
 		ctStart := mime[:6]
@@ -218,6 +321,9 @@ type fsCache struct {
 	disk     io.WriteCloser
 	wc       io.WriteCloser
 	mimefile io.WriteCloser
+	path     string // absolute on-disk path, for LRU tracking; empty when untracked
+	mimePath string // absolute .mime sidecar path, for LRU tracking; empty when untracked
+	cache    *lruIndex
 }
 
 func (m *fsCache) Write(b []byte) (i int, err error) {
@@ -226,15 +332,26 @@ func (m *fsCache) Write(b []byte) (i int, err error) {
 
 func (m *fsCache) Close() error {
 	m.wc.Close() // ignore gzip errors because bytes are already written.
-	return m.disk.Close()
+	err := m.disk.Close()
+	if m.cache != nil && m.path != "" {
+		if st, statErr := os.Stat(m.path); statErr == nil {
+			m.cache.add(m.path, st.Size())
+		}
+	}
+	return err
 }
 
 func (m *fsCache) WriteMIME(s string) {
 	m.mimefile.Write([]byte(s))
 	m.mimefile.Close()
+	if m.cache != nil && m.mimePath != "" {
+		if st, statErr := os.Stat(m.mimePath); statErr == nil {
+			m.cache.add(m.mimePath, st.Size())
+		}
+	}
 }
 
-func (o *outBuf) FS(sys fs.FS, origPath string, creat CreateFile, staticBase string) (handled bool) {
+func (o *outBuf) FS(sys fs.FS, origPath string, creat CreateFile, staticBase string, cache *lruIndex, rangeMode RangeMode) (handled bool) {
 	if o.req.Method != http.MethodGet {
 		return false // don't cache
 	}
@@ -250,7 +367,7 @@ func (o *outBuf) FS(sys fs.FS, origPath string, creat CreateFile, staticBase str
 	if !ok || st == nil {
 		o.Errors = append(o.Errors, fmt.Errorf("isn't statfs"))
 	}
-	o.cmpType = o.shouldCompress()
+	o.cmpType = o.shouldCompress(StaticLevels)
 	dest := origFullPath + "." + ceString[o.cmpType]
 	if o.cmpType == none {
 		return false
@@ -261,6 +378,9 @@ func (o *outBuf) FS(sys fs.FS, origPath string, creat CreateFile, staticBase str
 		if err != nil || compressedStat.IsDir() || origStat.IsDir() {
 			return false // no file. No future.
 		}
+		if compressedStat.Size() == 0 { // "SHOULD NOT COMPRESS" sentinel, same convention as the static walker
+			return false
+		}
 		if h := o.req.Header.Get("if-modified-since"); len(h) > 0 {
 			if t, err := time.Parse(time.RFC1123, h); err == nil {
 				if origStat.ModTime().Before(t) {
@@ -297,6 +417,30 @@ func (o *outBuf) FS(sys fs.FS, origPath string, creat CreateFile, staticBase str
 			}
 			h := o.ResponseWriter.Header()
 			h.Add("content-type", string(b))
+
+			if rng := o.req.Header.Get("Range"); rng != "" && rangeMode != RangeDeny {
+				if rangeMode == RangeAllow {
+					if ra, ok := f.(io.ReaderAt); ok {
+						if start, length, okRange := parseSingleRange(rng, compressedStat.Size()); okRange {
+							h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, compressedStat.Size()))
+							h.Set("Content-Length", strconv.FormatInt(length, 10))
+							headersFor(h, o.cmpType)
+							o.ResponseWriter.WriteHeader(http.StatusPartialContent)
+							if _, err := io.Copy(o.ResponseWriter, io.NewSectionReader(ra, start, length)); err != nil {
+								o.Errors = append(o.Errors, fmt.Errorf("range copy err: %w", err))
+							}
+							if cache != nil {
+								cache.touch(origFullPath + "." + ceString[o.cmpType]) // dest lost its leading '/' above
+							}
+							return true
+						}
+					}
+				}
+				// SkipCompression, or a cached range we can't satisfy:
+				// let the caller fall back to serving the uncompressed source.
+				return false
+			}
+
 			headersFor(h, o.cmpType)
 
 			_, err = io.Copy(o.ResponseWriter, f)
@@ -304,6 +448,9 @@ func (o *outBuf) FS(sys fs.FS, origPath string, creat CreateFile, staticBase str
 				o.Errors = append(o.Errors, fmt.Errorf("Copy err: %w", err))
 				return true
 			}
+			if cache != nil {
+				cache.touch(origFullPath + "." + ceString[o.cmpType]) // dest lost its leading '/' above
+			}
 			return true
 		}
 	}
@@ -320,7 +467,7 @@ func (o *outBuf) FS(sys fs.FS, origPath string, creat CreateFile, staticBase str
 			return
 		}
 
-		_, err = o.compressorCatchup(StaticLevels, &fsCache{disk: outfile, mimefile: mimefile})
+		_, err = o.compressorCatchup(StaticLevels, &fsCache{disk: outfile, mimefile: mimefile, path: dest, mimePath: origFullPath + ".mime", cache: cache})
 		if err != nil {
 			o.Errors = append(o.Errors, err)
 		}
@@ -332,6 +479,17 @@ type CacheOpts struct {
 	fs.FS
 	CreateFile
 	BasePath string
+	// MaxBytes bounds the total size of cached artifacts under BasePath,
+	// evicting least-recently-used entries first. 0 leaves it unbounded.
+	MaxBytes int64
+	// RangeMode controls how Range requests are handled. Default (zero
+	// value) is RangeAllow.
+	RangeMode RangeMode
+}
+
+// Purge removes every on-disk cache artifact tracked for opts.BasePath.
+func (opts CacheOpts) Purge() {
+	PurgeCache(opts.BasePath)
 }
 
 // FS is a convenience function for informing the cacher
@@ -344,7 +502,7 @@ type CacheOpts struct {
 // }
 // serveFile("static/foo.txt")
 func FS(w io.Writer, opts CacheOpts, origPath string) (handled bool) {
-	return w.(*outBuf).FS(opts.FS, origPath, opts.CreateFile, opts.BasePath)
+	return w.(*outBuf).FS(opts.FS, origPath, opts.CreateFile, opts.BasePath, getCacheIndex(opts.BasePath, opts.MaxBytes), opts.RangeMode)
 }
 
 type CreateFile func(path string) (io.WriteCloser, error)
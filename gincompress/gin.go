@@ -35,13 +35,13 @@ func DiskCacheMiddleware(cacheControlHeader, basepath, urlPrefix string) func(*g
 	}
 }
 
-// TODO statics. Tricky: HEAD. Accept Range, TE (transfer encoding)
-// gin relies on http.FileSystem
-// cannot just rewrite requested file to another name b/c ranges foul-up: they're based on the original range.
-// solution 1: abandon static on range requests else yield to http.FileSystem with compression:none
-// solution 2: ensure dynamic is used and set TE header. OVERRIDE??
-// because we MUST NOT set encoding on outbound in dynamic wrapper nor local.
-// Also, respect static inside dynamic (no change if set).
+// Range requests: gowebcompress.FS serves the requested byte range out of
+// the compressed cache (status 206, TE instead of Content-Encoding) when
+// RangeMode is RangeAllow (the default here) and a cache hit covers it.
+// Otherwise it returns false so gin's normal http.FileSystem handling
+// serves the uncompressed source with a standard ServeContent response.
+//
+// TODO statics. Tricky: HEAD.
 
 type writer struct {
 	gin.ResponseWriter
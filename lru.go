@@ -0,0 +1,160 @@
+package gowebcompress
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheSuffixes lists the on-disk artifacts the LRU index tracks:
+// StaticObj's .gz/.br/.zst, and FS()'s .gzip/.br/.zstd plus .mime.
+// Anything else under a cache root is left alone.
+var cacheSuffixes = []string{".gz", ".gzip", ".br", ".zst", ".zstd", ".mime"}
+
+func isCacheArtifact(name string) bool {
+	for _, s := range cacheSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheIndexes shares one lruIndex per BasePath across requests, since
+// CacheOpts is rebuilt on every call to FS() but the on-disk cache it
+// describes is not.
+var cacheIndexes sync.Map // basePath string -> *lruIndex
+
+// getCacheIndex returns (creating and rebuilding if necessary) the shared
+// lruIndex for basePath. It returns nil when maxBytes is 0 (unbounded).
+func getCacheIndex(basePath string, maxBytes int64) *lruIndex {
+	if maxBytes <= 0 {
+		return nil
+	}
+	if v, ok := cacheIndexes.Load(basePath); ok {
+		return v.(*lruIndex)
+	}
+	idx := newLRUIndex(maxBytes)
+	idx.rebuild(basePath)
+	go idx.runCompactor(time.Minute)
+	actual, _ := cacheIndexes.LoadOrStore(basePath, idx)
+	return actual.(*lruIndex)
+}
+
+// PurgeCache removes every on-disk cache artifact tracked for basePath by
+// the dynamic FS()/CacheOpts path, the CacheOpts equivalent of
+// StaticObj.Purge. It's a no-op if basePath was never used with a
+// MaxBytes > 0 (no lruIndex was ever created for it).
+func PurgeCache(basePath string) {
+	if v, ok := cacheIndexes.Load(basePath); ok {
+		v.(*lruIndex).Purge()
+	}
+}
+
+type cacheEntry struct {
+	size  int64
+	atime time.Time
+}
+
+// lruIndex tracks total bytes used by a cache directory and evicts the
+// least-recently-used entries when adding a new one would exceed maxBytes.
+// A maxBytes of 0 disables eviction; entries are still tracked.
+type lruIndex struct {
+	mu       sync.Mutex
+	maxBytes int64
+	total    int64
+	entries  map[string]*cacheEntry
+}
+
+func newLRUIndex(maxBytes int64) *lruIndex {
+	return &lruIndex{maxBytes: maxBytes, entries: make(map[string]*cacheEntry)}
+}
+
+// rebuild walks root and indexes existing cache artifacts, using each
+// file's mtime as a proxy for atime since most filesystems mount noatime.
+func (l *lruIndex) rebuild(root string) {
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || info.IsDir() || !isCacheArtifact(p) {
+			return nil
+		}
+		l.mu.Lock()
+		l.entries[p] = &cacheEntry{size: info.Size(), atime: info.ModTime()}
+		l.total += info.Size()
+		l.mu.Unlock()
+		return nil
+	})
+}
+
+// touch refreshes the recency of path on a cache hit.
+func (l *lruIndex) touch(path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[path]; ok {
+		e.atime = time.Now()
+	}
+}
+
+// add registers a newly written cache artifact, evicting the
+// least-recently-used entries first if it would exceed maxBytes.
+func (l *lruIndex) add(path string, size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[path]; ok {
+		l.total -= e.size
+		delete(l.entries, path) // so eviction can't remove the file just written
+	}
+	l.evictLocked(size)
+	l.entries[path] = &cacheEntry{size: size, atime: time.Now()}
+	l.total += size
+}
+
+// evictLocked removes oldest entries until adding `needed` more bytes
+// would fit within maxBytes. Caller must hold l.mu.
+func (l *lruIndex) evictLocked(needed int64) {
+	if l.maxBytes <= 0 || l.total+needed <= l.maxBytes {
+		return
+	}
+	type kv struct {
+		path string
+		e    *cacheEntry
+	}
+	ordered := make([]kv, 0, len(l.entries))
+	for p, e := range l.entries {
+		ordered = append(ordered, kv{p, e})
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].e.atime.Before(ordered[j].e.atime) })
+	for _, kv := range ordered {
+		if l.total+needed <= l.maxBytes {
+			return
+		}
+		os.Remove(kv.path)
+		delete(l.entries, kv.path)
+		l.total -= kv.e.size
+	}
+}
+
+// Purge removes every tracked cache artifact and resets the index.
+func (l *lruIndex) Purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for p := range l.entries {
+		os.Remove(p)
+	}
+	l.entries = make(map[string]*cacheEntry)
+	l.total = 0
+}
+
+// runCompactor periodically re-checks the budget so an index that is over
+// it (e.g. rebuilt from a cache directory already larger than maxBytes)
+// gets trimmed outside the request path. Files written without going
+// through add aren't counted, so they never trigger a trim.
+func (l *lruIndex) runCompactor(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mu.Lock()
+		l.evictLocked(0)
+		l.mu.Unlock()
+	}
+}
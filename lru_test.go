@@ -0,0 +1,175 @@
+package gowebcompress
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLRUIndexAddEvicts(t *testing.T) {
+	dir := t.TempDir()
+	mk := func(name string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	idx := newLRUIndex(100)
+
+	a, b, c := mk("a.gz"), mk("b.gz"), mk("c.gz")
+	idx.add(a, 40)
+	time.Sleep(time.Millisecond) // ensure distinct atimes
+	idx.add(b, 40)
+
+	if idx.total != 80 {
+		t.Fatalf("total = %d, want 80", idx.total)
+	}
+
+	// Adding c (40 bytes) would bring the total to 120, over the 100 cap,
+	// so the least-recently-used entry (a) must be evicted first.
+	idx.add(c, 40)
+
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Fatalf("expected a.gz to be evicted from disk, stat err = %v", err)
+	}
+	if _, ok := idx.entries[a]; ok {
+		t.Fatal("expected a.gz to be evicted from the index")
+	}
+	if _, ok := idx.entries[b]; !ok {
+		t.Fatal("expected b.gz to survive eviction")
+	}
+	if idx.total != 80 {
+		t.Fatalf("total after eviction = %d, want 80", idx.total)
+	}
+}
+
+func TestLRUIndexAddEvictsMultiple(t *testing.T) {
+	dir := t.TempDir()
+	mk := func(name string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	idx := newLRUIndex(100)
+	a, b, c, d := mk("a.gz"), mk("b.gz"), mk("c.gz"), mk("d.gz")
+	for _, p := range []string{a, b, c} {
+		idx.add(p, 30)
+		time.Sleep(time.Millisecond)
+	}
+	// total is 90; adding d (50 bytes) needs two evictions (a, then b) to
+	// get back under 100, since evicting a alone only frees it to 110.
+	idx.add(d, 50)
+
+	for _, p := range []string{a, b} {
+		if _, ok := idx.entries[p]; ok {
+			t.Fatalf("expected %s to be evicted", p)
+		}
+	}
+	for _, p := range []string{c, d} {
+		if _, ok := idx.entries[p]; !ok {
+			t.Fatalf("expected %s to survive", p)
+		}
+	}
+	if idx.total != 80 {
+		t.Fatalf("total after eviction = %d, want 80", idx.total)
+	}
+}
+
+func TestLRUIndexAddOversizedEntryEvictsEverything(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.gz")
+	if err := os.WriteFile(p, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := newLRUIndex(100)
+	idx.add(p, 50)
+
+	big := filepath.Join(dir, "big.gz")
+	if err := os.WriteFile(big, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// big alone (150 bytes) exceeds maxBytes, so every existing entry is
+	// evicted but big is still tracked afterward even though it alone
+	// keeps the index over budget.
+	idx.add(big, 150)
+
+	if _, ok := idx.entries[p]; ok {
+		t.Fatal("expected a.gz to be evicted")
+	}
+	if _, ok := idx.entries[big]; !ok {
+		t.Fatal("expected big.gz to be tracked")
+	}
+	if idx.total != 150 {
+		t.Fatalf("total = %d, want 150", idx.total)
+	}
+}
+
+func TestLRUIndexTouchUpdatesRecency(t *testing.T) {
+	dir := t.TempDir()
+	mk := func(name string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	idx := newLRUIndex(100)
+	a, b, c := mk("a.gz"), mk("b.gz"), mk("c.gz")
+	idx.add(a, 40)
+	time.Sleep(time.Millisecond)
+	idx.add(b, 40)
+
+	// Touching a makes it more recent than b, so adding c should evict b
+	// instead of a.
+	time.Sleep(time.Millisecond)
+	idx.touch(a)
+	idx.add(c, 40)
+
+	if _, ok := idx.entries[a]; !ok {
+		t.Fatal("expected a.gz (touched) to survive")
+	}
+	if _, ok := idx.entries[b]; ok {
+		t.Fatal("expected b.gz to be evicted")
+	}
+}
+
+func TestLRUIndexPurge(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.gz")
+	if err := os.WriteFile(p, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := newLRUIndex(100)
+	idx.add(p, 40)
+	idx.Purge()
+
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf("expected a.gz to be removed by Purge, stat err = %v", err)
+	}
+	if len(idx.entries) != 0 || idx.total != 0 {
+		t.Fatalf("expected empty index after Purge, got entries=%d total=%d", len(idx.entries), idx.total)
+	}
+}
+
+func TestLRUIndexUnboundedNeverEvicts(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.gz")
+	if err := os.WriteFile(p, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := newLRUIndex(0) // maxBytes <= 0 disables eviction
+	idx.add(p, 1<<30)
+	if _, ok := idx.entries[p]; !ok {
+		t.Fatal("expected entry to be tracked even when far over an unbounded cap")
+	}
+}
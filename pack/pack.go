@@ -0,0 +1,221 @@
+// Package pack builds and serves "packfiles": a single file holding every
+// static asset under a directory, pre-compressed with the strongest
+// available encoder for gzip, brotli and zstd, plus an identity copy as
+// a fallback. It decouples the expensive compression pass from server
+// startup (run it once, offline, with cmd/gowebpacker) and lets a server
+// serve assets straight out of an mmap with no cache directory and no
+// first-request compression stall.
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/foobaz/go-zopfli/zopfli"
+	"github.com/itchio/go-brotli/enc"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic identifies a gowebcompress packfile; Version lets future formats
+// be rejected cleanly instead of misparsed.
+const (
+	Magic   = "GWCPACK1"
+	Version = 1
+
+	// headerSize is magic(8) + version(4) + indexOffset(8) + indexLength(8).
+	headerSize = 28
+)
+
+// identityEncoding marks the uncompressed fallback blob stored for every
+// entry, served when a client's Accept-Encoding matches none of the rest.
+const identityEncoding = "identity"
+
+type blobRef struct {
+	Offset uint64 `json:"offset"`
+	Length uint64 `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+type entry struct {
+	Mime      string             `json:"mime"`
+	Encodings map[string]blobRef `json:"encodings"`
+}
+
+type packIndex struct {
+	Entries map[string]entry `json:"entries"`
+}
+
+// BuildOpts configures Build.
+type BuildOpts struct {
+	SrcDir  string
+	OutPath string
+	Workers int // 0 picks runtime.NumCPU()
+}
+
+// Build walks SrcDir, compresses every regular file with zopfli gzip,
+// brotli quality 11 and zstd's best-compression level, and writes a
+// single packfile to OutPath: a small header, the concatenated
+// compressed (and identity) blobs, then a length-prefixed JSON index.
+func Build(opts BuildOpts) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	type job struct{ relPath, absPath string }
+	type result struct {
+		relPath string
+		mime    string
+		blobs   map[string][]byte
+		err     error
+	}
+
+	var files []job
+	err := filepath.WalkDir(opts.SrcDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(opts.SrcDir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, job{filepath.ToSlash(rel), p})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	jobs := make(chan job)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				blobs, err := compressAll(j.absPath)
+				results <- result{
+					relPath: j.relPath,
+					mime:    mime.TypeByExtension(filepath.Ext(j.absPath)),
+					blobs:   blobs,
+					err:     err,
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, j := range files {
+			jobs <- j
+		}
+		close(jobs)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	out, err := os.Create(opts.OutPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if _, err := w.Write(make([]byte, headerSize)); err != nil {
+		return err
+	}
+
+	offset := uint64(headerSize)
+	idx := packIndex{Entries: make(map[string]entry, len(files))}
+	for res := range results {
+		if res.err != nil {
+			return fmt.Errorf("pack: %s: %w", res.relPath, res.err)
+		}
+		e := entry{Mime: res.mime, Encodings: make(map[string]blobRef, len(res.blobs))}
+		for encName, blob := range res.blobs {
+			sum := sha256.Sum256(blob)
+			e.Encodings[encName] = blobRef{Offset: offset, Length: uint64(len(blob)), SHA256: hex.EncodeToString(sum[:])}
+			if _, err := w.Write(blob); err != nil {
+				return err
+			}
+			offset += uint64(len(blob))
+		}
+		idx.Entries[res.relPath] = e
+	}
+
+	indexBytes, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	indexOffset := offset
+	if _, err := w.Write(indexBytes); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	hdr := make([]byte, headerSize)
+	copy(hdr, Magic)
+	binary.BigEndian.PutUint32(hdr[8:], Version)
+	binary.BigEndian.PutUint64(hdr[12:], indexOffset)
+	binary.BigEndian.PutUint64(hdr[20:], uint64(len(indexBytes)))
+	if _, err := out.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+// compressAll reads path once and returns every encoding's compressed
+// bytes, keyed by the Content-Encoding token it would be served under.
+func compressAll(path string) (map[string][]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var gz bytes.Buffer
+	if err := zopfli.GzipCompress(&zopfli.Options{NumIterations: 15}, raw, &gz); err != nil {
+		return nil, err
+	}
+
+	var br bytes.Buffer
+	bw := enc.NewBrotliWriter(&br, &enc.BrotliWriterOptions{Quality: 11})
+	if _, err := bw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+
+	var zs bytes.Buffer
+	zw, err := zstd.NewWriter(&zs, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		"gzip":           gz.Bytes(),
+		"br":             br.Bytes(),
+		"zstd":           zs.Bytes(),
+		identityEncoding: raw,
+	}, nil
+}
@@ -0,0 +1,74 @@
+package gowebcompress
+
+import "strconv"
+
+// RangeMode controls how a compressed cache reacts to a Range request.
+type RangeMode int
+
+const (
+	// RangeAllow serves the byte range straight out of the compressed
+	// cache file, swapping Content-Encoding for TE (the default).
+	RangeAllow RangeMode = iota
+	// RangeSkipCompression always falls back to serving the
+	// uncompressed source via http.ServeContent for Range requests.
+	RangeSkipCompression
+	// RangeDeny ignores the Range header entirely and serves the full
+	// (possibly compressed) body, as if it weren't sent.
+	RangeDeny
+)
+
+// parseSingleRange parses a "Range: bytes=..." header for a single range
+// against a resource of the given size. It reports ok=false for anything
+// it can't safely satisfy by itself: missing/malformed headers and, most
+// importantly, multi-range requests, which callers should satisfy some
+// other way (e.g. falling back to http.ServeContent).
+func parseSingleRange(header string, size int64) (start, length int64, ok bool) {
+	const prefix = "bytes="
+	if len(header) <= len(prefix) || header[:len(prefix)] != prefix {
+		return 0, 0, false
+	}
+	spec := header[len(prefix):]
+	for i := range spec {
+		if spec[i] == ',' {
+			return 0, 0, false // multi-range: let the caller fall back
+		}
+	}
+	dash := -1
+	for i := range spec {
+		if spec[i] == '-' {
+			dash = i
+			break
+		}
+	}
+	if dash < 0 {
+		return 0, 0, false
+	}
+	startStr, endStr := spec[:dash], spec[dash+1:]
+
+	if startStr == "" { // suffix range: last N bytes
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	startI, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || startI < 0 || startI >= size {
+		return 0, 0, false
+	}
+	endI := size - 1
+	if endStr != "" {
+		endI, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || endI < startI {
+			return 0, 0, false
+		}
+	}
+	if endI >= size {
+		endI = size - 1
+	}
+	return startI, endI - startI + 1, true
+}
@@ -0,0 +1,48 @@
+package gowebcompress
+
+import "testing"
+
+func TestParseSingleRange(t *testing.T) {
+	const size = 1000
+
+	cases := []struct {
+		name       string
+		header     string
+		wantStart  int64
+		wantLength int64
+		wantOK     bool
+	}{
+		{"basic", "bytes=0-499", 0, 500, true},
+		{"mid-range", "bytes=500-999", 500, 500, true},
+		{"open-ended", "bytes=900-", 900, 100, true},
+		{"suffix", "bytes=-500", 500, 500, true},
+		{"suffix larger than size clamps", "bytes=-10000", 0, 1000, true},
+		{"end clamps to size-1", "bytes=0-999999", 0, 1000, true},
+		{"single byte", "bytes=999-999", 999, 1, true},
+		{"missing prefix", "0-499", 0, 0, false},
+		{"empty spec", "bytes=", 0, 0, false},
+		{"multi-range rejected", "bytes=0-499,600-700", 0, 0, false},
+		{"no dash", "bytes=abc", 0, 0, false},
+		{"start not a number", "bytes=x-499", 0, 0, false},
+		{"start at size is out of bounds", "bytes=1000-", 0, 0, false},
+		{"start past size", "bytes=2000-2500", 0, 0, false},
+		{"end before start", "bytes=500-100", 0, 0, false},
+		{"suffix of zero is invalid", "bytes=-0", 0, 0, false},
+		{"negative suffix is invalid", "bytes=--5", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start, length, ok := parseSingleRange(c.header, size)
+			if ok != c.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, c.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if start != c.wantStart || length != c.wantLength {
+				t.Fatalf("got (start=%d, length=%d), want (start=%d, length=%d)", start, length, c.wantStart, c.wantLength)
+			}
+		})
+	}
+}
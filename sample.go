@@ -0,0 +1,20 @@
+package gowebcompress
+
+// sampleSize is how much of a file/response is read before deciding
+// whether compressing the rest is worthwhile.
+const sampleSize = 4096
+
+// MinCompressRatio is the compressed/original size threshold above which
+// a sample is considered incompressible. Dynamic responses consult it only
+// when SampleCompress is true; SetCompressSampling(0) also takes its
+// current value as the static default. 0.8 means: if compressing doesn't
+// shrink the sample by at least 20%, don't bother compressing the rest.
+var MinCompressRatio = 0.8
+
+// SampleCompress enables the dynamic-response sampling heuristic: the bytes
+// buffered before the response reaches sampleSize are compressed once and
+// their ratio compared against MinCompressRatio before committing to
+// compress the whole response. A response whose first Write alone reaches
+// sampleSize has nothing buffered and is not sampled. Off by default since
+// it costs one extra compression pass per response.
+var SampleCompress = false
@@ -1,17 +1,21 @@
 package gowebcompress
 
 import (
+	"bytes"
 	"compress/gzip"
-	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"runtime"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"gopkg.in/kothar/brotli-go.v0/enc"
 )
 
@@ -28,10 +32,11 @@ func SetDest(dest string) StaticOpts {
 
 // SetCompressionLevel lets you select something other than
 // the max compression. 0 disables that type.
-func SetCompressionLevel(gz, br int) StaticOpts {
+func SetCompressionLevel(gz, br, zs int) StaticOpts {
 	return func(staticObj *StaticObj) {
 		staticObj.gz = gz
 		staticObj.br = br
+		staticObj.zs = zs
 	}
 }
 
@@ -43,26 +48,82 @@ func SetParallelism(p int) StaticOpts {
 	}
 }
 
-// NewStatic provides a tool for accelerating a static request.
-// Opts are available to adjust its behavior.
-// This call starts background workers to pre-cache the content in a non-blocking way.
-// Use the member functions in handlers to do the actual send.
+// SetMaxCacheBytes bounds the total size of .gz/.br/.zst/.mime files kept
+// under dest, evicting least-recently-used entries first. 0 (the default)
+// leaves the cache unbounded.
+func SetMaxCacheBytes(maxBytes int64) StaticOpts {
+	return func(staticObj *StaticObj) {
+		staticObj.maxCacheBytes = maxBytes
+	}
+}
+
+// SetRangeMode controls how Range requests interact with the compressed
+// cache. Default is RangeAllow.
+func SetRangeMode(mode RangeMode) StaticOpts {
+	return func(staticObj *StaticObj) {
+		staticObj.rangeMode = mode
+	}
+}
+
+// SetCompressSampling enables a cheap pre-check: before compressing a
+// whole file, the first 4 KiB is compressed and compared against
+// minRatio (0 picks the default, 0.8). If the sample doesn't shrink
+// enough, the file is skipped and flagged "SHOULD NOT COMPRESS" just
+// like an oversized result would be. This catches binary formats whose
+// MIME type doesn't give away that they're already compressed.
+func SetCompressSampling(minRatio float64) StaticOpts {
+	if minRatio <= 0 {
+		minRatio = MinCompressRatio
+	}
+	return func(staticObj *StaticObj) {
+		staticObj.sampleCompress = true
+		staticObj.minCompressRatio = minRatio
+	}
+}
+
+// NewStatic provides a tool for accelerating a static request from a
+// folder on the local filesystem. Opts are available to adjust its
+// behavior. This call starts background workers to pre-cache the
+// content in a non-blocking way. Use the member functions in handlers
+// to do the actual send.
 func NewStatic(srcFolder string, opts ...StaticOpts) *StaticObj {
-	s := &StaticObj{gz: 9, br: 11, dest: "/tmp/gowebcache", src: srcFolder, numWorkers: 4}
+	return NewStaticFS(os.DirFS(srcFolder), opts...)
+}
+
+// NewStaticFS is NewStatic for any fs.FS: embed.FS, an in-memory test
+// filesystem, or a virtual overlay, in addition to os.DirFS. The
+// compressed cache itself still lives on the local filesystem under
+// dest, so embedded assets are pre-compressed to disk on first run.
+func NewStaticFS(fsys fs.FS, opts ...StaticOpts) *StaticObj {
+	s := &StaticObj{gz: 9, br: 11, zs: int(zstd.SpeedBestCompression), dest: "/tmp/gowebcache", src: fsys, numWorkers: 4}
 	for _, o := range opts {
 		o(s)
 	}
 
 	os.MkdirAll(s.dest, os.ModePerm|os.ModeDir)
 
-	s.Compress(s.src)
+	if s.maxCacheBytes > 0 {
+		s.cache = newLRUIndex(s.maxCacheBytes)
+		s.cache.rebuild(s.dest)
+		go s.cache.runCompactor(time.Minute)
+	}
+
+	s.Compress(".")
 	return s
 }
 
-// Compress enqueues files under this path to be compressed
-// into the cache. Only files newer than the previous cache run will
-// be processed. This is called when Static is initialized or a new
-// file is served and is rarely needed otherwise.
+// Purge removes every on-disk cache artifact tracked by SetMaxCacheBytes.
+// It is a no-op when no cache limit was configured.
+func (s *StaticObj) Purge() {
+	if s.cache != nil {
+		s.cache.Purge()
+	}
+}
+
+// Compress enqueues files under this path (an fs.FS path, "." for the
+// whole tree) to be compressed into the cache. Only files newer than
+// the previous cache run will be processed. This is called when Static
+// is initialized or a new file is served and is rarely needed otherwise.
 func (s *StaticObj) Compress(path string) {
 	s.walkerLock.Lock()
 	defer s.walkerLock.Unlock()
@@ -72,39 +133,54 @@ func (s *StaticObj) Compress(path string) {
 	}
 }
 
-// StaticObj enables high-compression static local content sends.
+// StaticObj enables high-compression static content sends out of any
+// fs.FS. The compressed cache is always kept on the local filesystem.
 type StaticObj struct {
 	gz         int
 	br         int
+	zs         int
 	dest       string
-	src        string
+	src        fs.FS
 	numWorkers int
 
+	maxCacheBytes int64
+	cache         *lruIndex
+
+	sampleCompress   bool
+	minCompressRatio float64
+
+	rangeMode RangeMode
+
 	walkerLock      sync.Mutex
 	walkerIsRunning bool
 	walkerPaths     []string
 }
 
-// absPath returns the safe paths. It needs an extension to be valid.
+// absPath returns the fs.FS-relative source path and the local cache
+// path for relPath. It needs an extension to be valid. relPath is
+// cleaned as if rooted, so escapes like "../../etc/passwd" resolve to
+// "etc/passwd" inside s.src (and s.dest) instead of leaving it, and the
+// result is checked with fs.ValidPath rather than a string-prefix
+// comparison against s.dest.
 func (s *StaticObj) absPath(relPath string, encoding int) (src string, cache string, err error) {
-	q := path.Join(s.src, relPath)
-	if len(s.src) > len(q) || s.src != q[:len(s.src)] {
-		return "", "", errors.New("Request attempts to escape static with: " + relPath)
+	q := path.Clean("/" + relPath)[1:]
+	if q == "" {
+		q = "."
+	}
+	if !fs.ValidPath(q) {
+		return "", "", fmt.Errorf("request attempts to escape static with: %s", relPath)
 	}
 	if encoding == none {
 		return q, q, nil
 	}
-	r := path.Join(s.dest, relPath)
-	if len(s.dest) > len(q) || s.dest != q[:len(s.dest)] {
-		return "", "", errors.New("Request attempts to escape static with: " + relPath)
-	}
-	return q, r + healthyCache[encoding], nil
+	return q, path.Join(s.dest, q) + healthyCache[encoding], nil
 }
 
 var healthyCache = map[int]string{
-	none:   ".gz", // Check GZ if not specified
-	brType: ".br",
-	gzType: ".gz",
+	none:    ".gz", // Check GZ if not specified
+	brType:  ".br",
+	gzType:  ".gz",
+	zstType: ".zst",
 }
 
 // SendFile will send the browser a file. It presumes nothing else was sent
@@ -118,30 +194,98 @@ func (s *StaticObj) SendFile(r *http.Request, w http.ResponseWriter, relPath str
 	if err != nil {
 		return err
 	}
-	sstat, err := os.Stat(srcPath)
+	sstat, err := fs.Stat(s.src, srcPath)
 	if err != nil {
 		return err // err src not found
 	}
 
+	if rng := r.Header.Get("Range"); rng != "" && s.rangeMode != RangeDeny {
+		return s.sendRange(r, w, rng, srcPath, cachePath, encoding, sstat)
+	}
+
 	cstat, cerr := os.Stat(cachePath)
 	if cerr == nil && cstat.Size() == 0 { // Handle the "SHOULD NOT COMPRESS" case
-		sendFile(srcPath, w)
-		return nil
+		return s.sendSrcFile(srcPath, w)
 	}
 	if cerr != nil || sstat.ModTime().After(cstat.ModTime()) { // cache outdated
-		s.Compress(cachePath)
-		uncompresedWriter, err := makeCompressor(encoding, w)
+		s.Compress(srcPath)
+		uncompresedWriter, err := makeCompressor(encoding, w, StaticLevels, nil)
 		if err != nil {
 			return err
 		}
-		err = sendFile(srcPath, uncompresedWriter)
+		return s.sendSrcFile(srcPath, uncompresedWriter)
+	}
+	// serve cached bits
+	headersFor(w.Header(), encoding)
+	sendFile(cachePath, w)
+	if s.cache != nil {
+		s.cache.touch(cachePath)
+	}
+	return nil
+}
+
+func (s *StaticObj) sendSrcFile(srcPath string, w io.Writer) error {
+	f, err := s.src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// sendRange serves a Range request, preferring a byte range of the
+// compressed cache file (with Content-Range and an encoding swapped to
+// TE, matching headersFor) and falling back to the uncompressed source
+// via http.ServeContent when there's no usable cache or the request
+// covers multiple ranges.
+func (s *StaticObj) sendRange(r *http.Request, w http.ResponseWriter, rangeHeader, srcPath, cachePath string, encoding int, sstat fs.FileInfo) error {
+	if s.rangeMode == RangeAllow && encoding != none {
+		if cstat, err := os.Stat(cachePath); err == nil && cstat.Size() > 0 && !sstat.ModTime().After(cstat.ModTime()) {
+			if start, length, ok := parseSingleRange(rangeHeader, cstat.Size()); ok {
+				return s.sendCachedRange(w, cachePath, start, length, cstat.Size(), encoding)
+			}
+		}
+	}
+	return s.serveUncompressedRange(r, w, srcPath, sstat)
+}
+
+func (s *StaticObj) sendCachedRange(w http.ResponseWriter, cachePath string, start, length, total int64, encoding int) error {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	h := w.Header()
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, total))
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	headersFor(h, encoding) // Content-Range is set, so this swaps to TE
+	w.WriteHeader(http.StatusPartialContent)
+	_, err = io.CopyN(w, f, length)
+	return err
+}
+
+// serveUncompressedRange serves srcPath from s.src, falling back to
+// buffering the whole file when the fs.File doesn't support Seek (not
+// every fs.FS implementation, e.g. some virtual overlays, provides it).
+func (s *StaticObj) serveUncompressedRange(r *http.Request, w http.ResponseWriter, srcPath string, sstat fs.FileInfo) error {
+	f, err := s.src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(f)
 		if err != nil {
 			return err
 		}
-	} else { // serve cached bits
-		headersFor(w.Header(), encoding)
-		sendFile(cachePath, w)
+		rs = bytes.NewReader(b)
 	}
+	http.ServeContent(w, r, path.Base(srcPath), sstat.ModTime(), rs)
 	return nil
 }
 
@@ -183,14 +327,23 @@ func (s *StaticObj) walker() {
 							log.Println(err.Error())
 						}
 					}
+					if s.zs != 0 {
+						if err := s.makeStaticCompressed(path, zstType, s.zs); err != nil {
+							log.Println(err.Error())
+						}
+					}
 				}
 			}()
 		}
-		err := filepath.Walk(rootpath, func(walkpath string, info os.FileInfo, err error) error {
+		err := fs.WalkDir(s.src, rootpath, func(walkpath string, d fs.DirEntry, err error) error {
 			if err != nil {
-				return filepath.SkipDir
+				return fs.SkipDir
 			}
-			if info.IsDir() || info.Size() < 1024 {
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.Size() < 1024 {
 				return nil
 			}
 			if dest, err := os.Stat(path.Join(s.dest, walkpath)); err == nil && info.ModTime().Before(dest.ModTime()) {
@@ -207,32 +360,89 @@ func (s *StaticObj) walker() {
 }
 
 func (s *StaticObj) makeStaticCompressed(srcPath string, encoding int, level int) error {
-	input, err := os.Open(srcPath)
+	input, err := s.src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	instat, err := input.Stat()
 	if err != nil {
 		return err
 	}
 
 	outPath := path.Join(s.dest, srcPath) + healthyCache[encoding] + "tmp"
-	os.MkdirAll(path.Base(outPath), os.ModeDir|os.ModePerm)
+	finalPath := outPath[:len(outPath)-3]
+
+	// body starts as the whole file; if sampling is on, the first
+	// sampleSize bytes are read up front to decide whether to bother,
+	// then stitched back in front of the rest so input is only ever
+	// read forward (fs.File doesn't guarantee Seek).
+	var body io.Reader = input
+	if s.sampleCompress {
+		sample := make([]byte, sampleSize)
+		n, err := io.ReadFull(input, sample)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		sample = sample[:n]
+		body = io.MultiReader(bytes.NewReader(sample), input)
+		if n > 0 {
+			compressed, err := compressedSampleSize(encoding, Levels{Gzip: level, Brotli: level, Zstd: level}, sample)
+			if err != nil {
+				return err
+			}
+			if float64(compressed)/float64(n) > s.minCompressRatio {
+				f, err := os.Create(finalPath)
+				if err != nil {
+					return err
+				}
+				f.Close()
+				if s.cache != nil {
+					s.cache.add(finalPath, 0)
+				}
+				return nil
+			}
+		}
+	}
+
+	os.MkdirAll(path.Dir(outPath), os.ModeDir|os.ModePerm)
 	outFile, err := os.Create(outPath)
 	if err != nil {
 		return err
 	}
 	defer outFile.Close()
-	if encoding == brType {
+	switch encoding {
+	case gzType:
 		cmp, err := gzip.NewWriterLevel(outFile, level)
 		if err != nil {
 			return err
 		}
-		if _, err := io.Copy(cmp, input); err != nil {
+		if _, err := io.Copy(cmp, body); err != nil {
 			return err
 		}
-	} else {
+		if err := cmp.Close(); err != nil {
+			return err
+		}
+	case zstType:
+		cmp, err := zstd.NewWriter(outFile, zstd.WithEncoderLevel(zstd.EncoderLevel(level)))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(cmp, body); err != nil {
+			return err
+		}
+		if err := cmp.Close(); err != nil {
+			return err
+		}
+	default:
 		brotliParam := enc.NewBrotliParams()
 
 		brotliParam.SetQuality(level)
 		cmp := enc.NewBrotliWriter(brotliParam, outFile)
-		if _, err := io.Copy(cmp, input); err != nil {
+		if _, err := io.Copy(cmp, body); err != nil {
+			return err
+		}
+		if err := cmp.Close(); err != nil {
 			return err
 		}
 	}
@@ -243,24 +453,26 @@ func (s *StaticObj) makeStaticCompressed(srcPath string, encoding int, level int
 	if err != nil {
 		return err
 	}
-	instat, err := input.Stat()
-	if err != nil {
-		return err
-	}
 	if outstat.Size()*9/10 > instat.Size() {
 		// It's too big to be worth it.
 		// Flag with a zero-size file
-		f, err := os.Create(outPath[:len(outPath)-3])
+		f, err := os.Create(finalPath)
 		if err != nil {
 			return err
 		}
 		f.Close()
+		if s.cache != nil {
+			s.cache.add(finalPath, 0)
+		}
 		return nil
 	}
 	if err := outFile.Close(); err != nil {
 		return err
 	}
-	if err := os.Rename(outPath, outPath[:len(outPath)-3]); err != nil {
+	if s.cache != nil {
+		s.cache.add(finalPath, outstat.Size())
+	}
+	if err := os.Rename(outPath, finalPath); err != nil {
 		return err
 	}
 	return nil